@@ -0,0 +1,391 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pprof
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deltaProfiles are the profile kinds for which WriteTo only ever emits a
+// cumulative snapshot, so the only way to see what changed over a window
+// is to diff two snapshots taken apart in time. CPU profiles are already
+// incremental -- the profile itself only covers [start, stop] -- so they
+// aren't included here; use Profile's existing seconds parameter instead.
+var deltaProfiles = map[string]bool{
+	"heap":   true,
+	"allocs": true,
+	"mutex":  true,
+	"block":  true,
+}
+
+// maxSnapshots bounds the snapshot cache so a client that keeps minting
+// ?base= IDs without reusing them can't grow it without bound.
+const maxSnapshots = 32
+
+// snapshotCache holds recent delta-profile snapshots keyed by a server-
+// generated ID, so a later request can diff against one with ?base=<id>
+// instead of re-collecting it. IDs are random rather than sequential so
+// that a caller who can reach the delta endpoint can't guess or
+// enumerate another caller's cached snapshot. Each entry also records
+// which profile it was taken from, so a ?base= minted by one profile's
+// endpoint can't be replayed against another's -- diffing, say, a heap
+// "before" against a block "after" would silently produce a plausible
+// but meaningless profile rather than an error.
+type snapshotCache struct {
+	mu    sync.Mutex
+	order []string
+	data  map[string]snapshotEntry
+}
+
+type snapshotEntry struct {
+	name    string
+	profile *pbProfile
+}
+
+var snapshots = &snapshotCache{data: make(map[string]snapshotEntry)}
+
+func (c *snapshotCache) put(name string, p *pbProfile) (string, error) {
+	id, err := randomSnapshotID()
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[id] = snapshotEntry{name: name, profile: p}
+	c.order = append(c.order, id)
+	if len(c.order) > maxSnapshots {
+		delete(c.data, c.order[0])
+		c.order = c.order[1:]
+	}
+	return id, nil
+}
+
+// randomSnapshotID returns a 128-bit random token, hex-encoded.
+func randomSnapshotID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// get returns the cached snapshot for id, provided it was taken from the
+// named profile; a snapshot cached under a different profile name is
+// reported as not found.
+func (c *snapshotCache) get(name, id string) (*pbProfile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.data[id]
+	if !ok || e.name != name {
+		return nil, false
+	}
+	return e.profile, true
+}
+
+// DeltaHandler returns an HTTP handler that serves the difference between
+// two snapshots of the named profile taken window apart -- the same
+// comparison `go tool pprof -base` makes between two files, but computed
+// server-side so a single request is enough to see what changed. name
+// must be one of the profiles in deltaProfiles.
+func DeltaHandler(name string, window time.Duration) http.Handler {
+	return deltaHandler{name: name, window: window}
+}
+
+type deltaHandler struct {
+	name   string
+	window time.Duration
+}
+
+func (h deltaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !deltaProfiles[h.name] {
+		serveError(w, http.StatusNotFound, "Unknown delta profile")
+		return
+	}
+	p := pprof.Lookup(h.name)
+	if p == nil {
+		serveError(w, http.StatusNotFound, "Unknown profile")
+		return
+	}
+
+	window := h.window
+	if s := r.FormValue("seconds"); s != "" {
+		sec, err := strconv.ParseFloat(s, 64)
+		if err != nil || sec <= 0 {
+			serveError(w, http.StatusBadRequest, "invalid seconds")
+			return
+		}
+		window = time.Duration(sec * float64(time.Second))
+	}
+
+	var before *pbProfile
+	if id := r.FormValue("base"); id != "" {
+		cached, ok := snapshots.get(h.name, id)
+		if !ok {
+			serveError(w, http.StatusNotFound, "Unknown base snapshot")
+			return
+		}
+		before = cached
+	} else {
+		// Only this branch actually sleeps out the window, so only it
+		// needs to be checked against the server's WriteTimeout.
+		if durationExceedsWriteTimeout(r, window.Seconds()) {
+			serveError(w, http.StatusBadRequest, "delta window exceeds server's WriteTimeout")
+			return
+		}
+		snap, err := takeSnapshot(p)
+		if err != nil {
+			serveError(w, http.StatusInternalServerError, fmt.Sprintf("Could not collect profile: %s", err))
+			return
+		}
+		before = snap
+		sleep(w, window)
+	}
+
+	after, err := takeSnapshot(p)
+	if err != nil {
+		serveError(w, http.StatusInternalServerError, fmt.Sprintf("Could not collect profile: %s", err))
+		return
+	}
+	id, err := snapshots.put(h.name, after)
+	if err != nil {
+		serveError(w, http.StatusInternalServerError, fmt.Sprintf("Could not cache snapshot: %s", err))
+		return
+	}
+
+	d, err := diffProfiles(before, after)
+	if err != nil {
+		serveError(w, http.StatusInternalServerError, fmt.Sprintf("Could not diff profiles: %s", err))
+		return
+	}
+	out, err := d.encode()
+	if err != nil {
+		serveError(w, http.StatusInternalServerError, fmt.Sprintf("Could not write profile: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-delta"`, h.name))
+	w.Header().Set("X-Pprof-Snapshot-Id", id)
+	w.Write(out)
+}
+
+// takeSnapshot collects and decodes the current sample values of p.
+func takeSnapshot(p *pprof.Profile) (*pbProfile, error) {
+	var buf bytes.Buffer
+	if err := p.WriteTo(&buf, 0); err != nil {
+		return nil, err
+	}
+	return decodeProfile(buf.Bytes())
+}
+
+// stackFrame is one (function, file, line) resolved from a Location's
+// Line entries, which is itself resolved through a profile's own
+// Function table -- the part of the pprof proto decodeProfile leaves as
+// opaque pass-through, since diffProfiles is the only caller that needs
+// to look inside it.
+type stackFrame struct {
+	Func string
+	File string
+	Line int64
+}
+
+// decodeFunctions resolves a profile's Function table (top-level field
+// 5) from its pass-through fields.
+func decodeFunctions(other []pbField, strTable []string) map[uint64]stackFrame {
+	out := make(map[uint64]stackFrame)
+	for _, f := range other {
+		if f.num != profileFieldFunction || f.wire != 2 {
+			continue
+		}
+		fields, err := parseFields(f.content)
+		if err != nil {
+			continue
+		}
+		var id uint64
+		var nameIdx, fileIdx int
+		for _, ff := range fields {
+			switch ff.num {
+			case functionFieldID:
+				id = ff.value
+			case functionFieldName:
+				nameIdx = int(ff.value)
+			case functionFieldFilename:
+				fileIdx = int(ff.value)
+			}
+		}
+		out[id] = stackFrame{Func: strAt(strTable, nameIdx), File: strAt(strTable, fileIdx)}
+	}
+	return out
+}
+
+// decodeLocations resolves a profile's Location table (top-level field
+// 4) into, for each location ID, the (possibly several, if frames were
+// inlined) stack frames it represents.
+func decodeLocations(other []pbField, funcs map[uint64]stackFrame) map[uint64][]stackFrame {
+	out := make(map[uint64][]stackFrame)
+	for _, f := range other {
+		if f.num != profileFieldLocation || f.wire != 2 {
+			continue
+		}
+		fields, err := parseFields(f.content)
+		if err != nil {
+			continue
+		}
+		var id uint64
+		var frames []stackFrame
+		for _, ff := range fields {
+			switch {
+			case ff.num == locationFieldID:
+				id = ff.value
+			case ff.num == locationFieldLine && ff.wire == 2:
+				lineFields, err := parseFields(ff.content)
+				if err != nil {
+					continue
+				}
+				var funcID uint64
+				var line int64
+				for _, lf := range lineFields {
+					switch lf.num {
+					case lineFieldFunctionID:
+						funcID = lf.value
+					case lineFieldLine:
+						line = int64(lf.value)
+					}
+				}
+				frame := funcs[funcID]
+				frame.Line = line
+				frames = append(frames, frame)
+			}
+		}
+		out[id] = frames
+	}
+	return out
+}
+
+// stackKey builds a key identifying a sample's stack and label set by
+// the function/file/line text it resolves to, rather than by its
+// location IDs. That indirection matters because runtime/pprof assigns
+// location IDs by enumerating a profile's buckets newest-first: a single
+// stack that's new since the last snapshot shifts every other stack's
+// ID, so two WriteTo calls moments apart can (and in practice routinely
+// do) number the very same call stack differently. Resolving through to
+// function/file/line first makes the key stable across that churn.
+func stackKey(ids []uint64, locs map[uint64][]stackFrame, tags map[string]string) string {
+	var b strings.Builder
+	for _, id := range ids {
+		for _, fr := range locs[id] {
+			fmt.Fprintf(&b, "%s|%s|%d;", fr.Func, fr.File, fr.Line)
+		}
+	}
+	b.WriteByte(0)
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s;", k, tags[k])
+	}
+	return b.String()
+}
+
+// accumulate adds (or, if negate, subtracts) values into totals[key],
+// extending totals[key] if values has more sample types than it's seen
+// before.
+func accumulate(totals map[string][]int64, key string, values []int64, negate bool) {
+	sum := totals[key]
+	for i, v := range values {
+		if i >= len(sum) {
+			sum = append(sum, make([]int64, i+1-len(sum))...)
+		}
+		if negate {
+			sum[i] -= v
+		} else {
+			sum[i] += v
+		}
+	}
+	totals[key] = sum
+}
+
+// diffProfiles computes after minus before the way `go tool pprof -base`
+// does: resolve each sample to a location-ID-independent stack key (see
+// stackKey), sum before's values negated against after's per key, and
+// keep only the after sample for any key whose total didn't net out to
+// zero. The result carries after's string, mapping, location, and
+// function tables; a stack that appears in before but not after -- which
+// shouldn't happen for heap/allocs/mutex/block, whose bucket lists only
+// grow -- has no safe representative to emit it with and is dropped.
+func diffProfiles(before, after *pbProfile) (*pbProfile, error) {
+	beforeFuncs := decodeFunctions(before.other, before.strTable)
+	beforeLocs := decodeLocations(before.other, beforeFuncs)
+	afterFuncs := decodeFunctions(after.other, after.strTable)
+	afterLocs := decodeLocations(after.other, afterFuncs)
+
+	totals := make(map[string][]int64)
+	for _, s := range before.samples {
+		ids, err := s.locationIDs()
+		if err != nil {
+			return nil, err
+		}
+		accumulate(totals, stackKey(ids, beforeLocs, s.tags), s.values, true)
+	}
+
+	type afterGroup struct {
+		sample *pbSample
+		key    string
+	}
+	var afterGroups []afterGroup
+	seen := make(map[string]bool)
+	for _, s := range after.samples {
+		ids, err := s.locationIDs()
+		if err != nil {
+			return nil, err
+		}
+		k := stackKey(ids, afterLocs, s.tags)
+		accumulate(totals, k, s.values, false)
+		if !seen[k] {
+			seen[k] = true
+			afterGroups = append(afterGroups, afterGroup{sample: s, key: k})
+		}
+	}
+
+	diff := &pbProfile{strTable: after.strTable, other: after.other}
+	for _, g := range afterGroups {
+		sum := totals[g.key]
+		nonzero := false
+		for _, v := range sum {
+			if v != 0 {
+				nonzero = true
+				break
+			}
+		}
+		if !nonzero {
+			continue
+		}
+		diff.samples = append(diff.samples, &pbSample{other: g.sample.other, values: sum, tags: g.sample.tags})
+	}
+	return diff, nil
+}
+
+// Delta responds with the difference between two snapshots of a delta-
+// capable profile (heap, allocs, mutex, block), taken ?seconds= apart, or
+// against a previously returned ?base= snapshot ID. The package
+// initialization registers it to handle /debug/pprof/delta/<profile>,
+// e.g. /debug/pprof/delta/heap?seconds=30.
+func Delta(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/delta/")
+	DeltaHandler(name, 30*time.Second).ServeHTTP(w, r)
+}
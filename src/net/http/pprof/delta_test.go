@@ -0,0 +1,203 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pprof
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/pprof"
+	"testing"
+	"time"
+)
+
+// snapshotHeap collects a decoded heap profile; used by
+// TestDiffProfilesKeepsGrowth, which cares about real sample data. Other
+// tests below build synthetic profiles instead, since two back-to-back
+// snapshots of the live heap are never quite identical -- the test
+// binary itself keeps allocating between them.
+func snapshotHeap(t *testing.T) *pbProfile {
+	t.Helper()
+	runtime.GC()
+	var buf bytes.Buffer
+	if err := pprof.Lookup("heap").WriteTo(&buf, 0); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	p, err := decodeProfile(buf.Bytes())
+	if err != nil {
+		t.Fatalf("decodeProfile: %v", err)
+	}
+	return p
+}
+
+func TestDiffProfilesDropsUnchangedSamples(t *testing.T) {
+	before := mkTestProfile(t, []int64{1, 2, 3}, 42)
+	after := mkTestProfile(t, []int64{1, 2, 3}, 42)
+	d, err := diffProfiles(before, after)
+	if err != nil {
+		t.Fatalf("diffProfiles: %v", err)
+	}
+	if len(d.samples) != 0 {
+		t.Fatalf("diffing two identical stacks: got %d samples, want 0", len(d.samples))
+	}
+}
+
+func TestDiffProfilesKeepsGrowth(t *testing.T) {
+	before := snapshotHeap(t)
+
+	var sink [][]byte
+	for i := 0; i < 200000; i++ {
+		sink = append(sink, make([]byte, 1024))
+	}
+
+	after := snapshotHeap(t)
+	d, err := diffProfiles(before, after)
+	if err != nil {
+		t.Fatalf("diffProfiles: %v", err)
+	}
+	if len(d.samples) == 0 {
+		t.Fatal("diffing after a 200MB allocation: got 0 samples, want at least one nonzero stack")
+	}
+	runtime.KeepAlive(sink)
+}
+
+// mkTestProfile builds a minimal one-sample pbProfile with the given
+// location IDs and value, exercising both the packed (>2 locations) and
+// unpacked (<=2 locations) wire encodings depending on len(locIDs).
+func mkTestProfile(t *testing.T, locIDs []int64, value int64) *pbProfile {
+	t.Helper()
+	var sampleContent []byte
+	if len(locIDs) > 2 {
+		packed := encodePackedVarints(locIDs)
+		sampleContent = appendTag(sampleContent, sampleFieldLocationID, 2)
+		sampleContent = appendVarint(sampleContent, uint64(len(packed)))
+		sampleContent = append(sampleContent, packed...)
+	} else {
+		for _, id := range locIDs {
+			sampleContent = appendTag(sampleContent, sampleFieldLocationID, 0)
+			sampleContent = appendVarint(sampleContent, uint64(id))
+		}
+	}
+	sampleContent = appendTag(sampleContent, sampleFieldValue, 0)
+	sampleContent = appendVarint(sampleContent, uint64(value))
+
+	s, err := decodeSample(sampleContent, nil)
+	if err != nil {
+		t.Fatalf("decodeSample: %v", err)
+	}
+	return &pbProfile{samples: []*pbSample{s}}
+}
+
+// TestDiffProfilesShortLocationList exercises the packed-vs-unpacked
+// decoding path directly: protobuf.uint64s (runtime/pprof/protobuf.go)
+// only packs a repeated field with more than two elements, so a sample
+// with one or two location IDs round-trips through a different wire
+// encoding than one with three or more. The same holds for the single
+// value, which is written unpacked here: it must be read for diffProfiles
+// to keep the sample at all, and the two location IDs must come through
+// the diff intact.
+func TestDiffProfilesShortLocationList(t *testing.T) {
+	before := mkTestProfile(t, []int64{1, 2}, 0)
+	after := mkTestProfile(t, []int64{1, 2}, 5)
+
+	d, err := diffProfiles(before, after)
+	if err != nil {
+		t.Fatalf("diffProfiles: %v", err)
+	}
+	if len(d.samples) != 1 {
+		t.Fatalf("got %d samples, want 1 (two-element location_id list must not be dropped)", len(d.samples))
+	}
+	if got := d.samples[0].values[0]; got != 5 {
+		t.Fatalf("diff value = %d, want 5", got)
+	}
+	ids, err := d.samples[0].locationIDs()
+	if err != nil {
+		t.Fatalf("locationIDs: %v", err)
+	}
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Fatalf("location IDs = %v, want [1 2]", ids)
+	}
+}
+
+func TestSnapshotCacheRejectsCrossProfileBase(t *testing.T) {
+	id, err := snapshots.put("heap", &pbProfile{})
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if _, ok := snapshots.get("block", id); ok {
+		t.Fatal("get(\"block\", id) succeeded for a snapshot cached under \"heap\"")
+	}
+	if _, ok := snapshots.get("heap", id); !ok {
+		t.Fatal("get(\"heap\", id) failed for a snapshot cached under \"heap\"")
+	}
+}
+
+// TestDeltaHandlerRejectsCrossProfileBase confirms the fix end-to-end: a
+// base ID minted by one delta endpoint can't be replayed against a
+// different one to produce a silently-bogus diff.
+func TestDeltaHandlerRejectsCrossProfileBase(t *testing.T) {
+	req := httptest.NewRequest("GET", "/debug/pprof/delta/heap?seconds=0.01", nil)
+	w := httptest.NewRecorder()
+	DeltaHandler("heap", 10*time.Millisecond).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("priming request: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	id := w.Header().Get("X-Pprof-Snapshot-Id")
+	if id == "" {
+		t.Fatal("priming request: missing X-Pprof-Snapshot-Id")
+	}
+
+	req2 := httptest.NewRequest("GET", "/debug/pprof/delta/block?base="+id, nil)
+	w2 := httptest.NewRecorder()
+	DeltaHandler("block", 10*time.Millisecond).ServeHTTP(w2, req2)
+	if w2.Code != http.StatusNotFound {
+		t.Fatalf("diffing block against a heap-minted base: status = %d, want 404; body = %s", w2.Code, w2.Body.String())
+	}
+
+	req3 := httptest.NewRequest("GET", "/debug/pprof/delta/heap?base="+id, nil)
+	w3 := httptest.NewRecorder()
+	DeltaHandler("heap", 10*time.Millisecond).ServeHTTP(w3, req3)
+	if w3.Code != http.StatusOK {
+		t.Fatalf("diffing heap against a heap-minted base: status = %d, want 200; body = %s", w3.Code, w3.Body.String())
+	}
+}
+
+// TestDeltaHandlerBaseSkipsTimeoutCheck confirms that ?base= bypasses the
+// WriteTimeout check: the handler never sleeps out ?seconds= on that
+// path, so checking it there only produces spurious rejections.
+func TestDeltaHandlerBaseSkipsTimeoutCheck(t *testing.T) {
+	srv := &http.Server{WriteTimeout: 10 * time.Millisecond}
+	withServer := func(r *http.Request) *http.Request {
+		ctx := context.WithValue(r.Context(), http.ServerContextKey, srv)
+		return r.WithContext(ctx)
+	}
+
+	req := withServer(httptest.NewRequest("GET", "/debug/pprof/delta/heap?seconds=0.001", nil))
+	w := httptest.NewRecorder()
+	DeltaHandler("heap", time.Millisecond).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("priming request: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	id := w.Header().Get("X-Pprof-Snapshot-Id")
+
+	// Without base, a window that exceeds WriteTimeout is rejected.
+	reqNoBase := withServer(httptest.NewRequest("GET", "/debug/pprof/delta/heap?seconds=60", nil))
+	wNoBase := httptest.NewRecorder()
+	DeltaHandler("heap", time.Millisecond).ServeHTTP(wNoBase, reqNoBase)
+	if wNoBase.Code != http.StatusBadRequest {
+		t.Fatalf("no base, seconds=60 exceeding WriteTimeout: status = %d, want 400", wNoBase.Code)
+	}
+
+	// With base, the same huge ?seconds= never triggers the check,
+	// since the handler doesn't sleep on this path.
+	reqBase := withServer(httptest.NewRequest("GET", "/debug/pprof/delta/heap?seconds=60&base="+id, nil))
+	wBase := httptest.NewRecorder()
+	DeltaHandler("heap", time.Millisecond).ServeHTTP(wBase, reqBase)
+	if wBase.Code != http.StatusOK {
+		t.Fatalf("base set, seconds=60: status = %d, want 200; body = %s", wBase.Code, wBase.Body.String())
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pprof
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// labelFilter is the decoded form of the label/tag query parameters
+// accepted by the goroutine, heap, mutex, block, and CPU profile
+// endpoints: ?label=key=value (repeatable), ?labelmatch=key=~regex, and
+// ?tagfocus=/?tagignore=, mirroring `go tool pprof`'s -tagfocus and
+// -tagignore flags. A sample is kept only if it satisfies every
+// constraint.
+type labelFilter struct {
+	equal  map[string]string
+	match  map[string]*regexp.Regexp
+	focus  *regexp.Regexp
+	ignore *regexp.Regexp
+}
+
+// parseLabelFilter reads the label-filtering query parameters from r. The
+// filter it returns when none are present is a no-op (see empty).
+func parseLabelFilter(r *http.Request) (*labelFilter, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	f := &labelFilter{equal: map[string]string{}, match: map[string]*regexp.Regexp{}}
+	for _, kv := range r.Form["label"] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed label %q, want key=value", kv)
+		}
+		f.equal[k] = v
+	}
+	for _, kv := range r.Form["labelmatch"] {
+		k, v, ok := strings.Cut(kv, "=~")
+		if !ok {
+			return nil, fmt.Errorf("malformed labelmatch %q, want key=~regex", kv)
+		}
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("labelmatch %q: %v", kv, err)
+		}
+		f.match[k] = re
+	}
+	if v := r.FormValue("tagfocus"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("tagfocus %q: %v", v, err)
+		}
+		f.focus = re
+	}
+	if v := r.FormValue("tagignore"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("tagignore %q: %v", v, err)
+		}
+		f.ignore = re
+	}
+	return f, nil
+}
+
+// empty reports whether f imposes no constraint, so callers can skip the
+// decode/filter/re-encode round trip entirely for the common case of an
+// unfiltered request.
+func (f *labelFilter) empty() bool {
+	return len(f.equal) == 0 && len(f.match) == 0 && f.focus == nil && f.ignore == nil
+}
+
+// keep reports whether a sample's tags (as decoded by decodeSample)
+// satisfy f.
+func (f *labelFilter) keep(tags map[string]string) bool {
+	for k, v := range f.equal {
+		if tags[k] != v {
+			return false
+		}
+	}
+	for k, re := range f.match {
+		if !re.MatchString(tags[k]) {
+			return false
+		}
+	}
+	if f.focus != nil && !matchesAnyTag(tags, f.focus) {
+		return false
+	}
+	if f.ignore != nil && matchesAnyTag(tags, f.ignore) {
+		return false
+	}
+	return true
+}
+
+func matchesAnyTag(tags map[string]string, re *regexp.Regexp) bool {
+	for k, v := range tags {
+		if re.MatchString(k + "=" + v) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterProfile decodes the pprof-encoded raw profile, drops every sample
+// that doesn't satisfy f, and re-encodes the result. This lets a service
+// that already tags its work with pprof.Labels extract, over HTTP, only
+// the samples for a given request ID or tenant.
+func filterProfile(raw []byte, f *labelFilter) ([]byte, error) {
+	p, err := decodeProfile(raw)
+	if err != nil {
+		return nil, err
+	}
+	kept := p.samples[:0]
+	for _, s := range p.samples {
+		if f.keep(s.tags) {
+			kept = append(kept, s)
+		}
+	}
+	p.samples = kept
+	return p.encode()
+}
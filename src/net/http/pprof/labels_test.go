@@ -0,0 +1,169 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pprof
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestParseLabelFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/debug/pprof/heap?label=req=abc&labelmatch=tenant=~^acme&tagfocus=slow&tagignore=test", nil)
+	f, err := parseLabelFilter(r)
+	if err != nil {
+		t.Fatalf("parseLabelFilter: %v", err)
+	}
+	if f.empty() {
+		t.Fatal("filter with query parameters set should not be empty")
+	}
+	if got, want := f.equal["req"], "abc"; got != want {
+		t.Errorf("equal[req] = %q, want %q", got, want)
+	}
+	if f.match["tenant"] == nil || !f.match["tenant"].MatchString("acme-1") {
+		t.Error("labelmatch regex for tenant did not compile or match as expected")
+	}
+	if f.focus == nil || !f.focus.MatchString("slow") {
+		t.Error("tagfocus regex did not compile or match as expected")
+	}
+	if f.ignore == nil || !f.ignore.MatchString("test") {
+		t.Error("tagignore regex did not compile or match as expected")
+	}
+}
+
+func TestParseLabelFilterEmpty(t *testing.T) {
+	r := httptest.NewRequest("GET", "/debug/pprof/heap", nil)
+	f, err := parseLabelFilter(r)
+	if err != nil {
+		t.Fatalf("parseLabelFilter: %v", err)
+	}
+	if !f.empty() {
+		t.Fatal("filter with no query parameters should be empty")
+	}
+}
+
+func TestParseLabelFilterMalformed(t *testing.T) {
+	r := httptest.NewRequest("GET", "/debug/pprof/heap?label=noequals", nil)
+	if _, err := parseLabelFilter(r); err == nil {
+		t.Fatal("expected an error for a label without a key=value split")
+	}
+}
+
+func TestLabelFilterKeep(t *testing.T) {
+	testCases := []struct {
+		name string
+		f    *labelFilter
+		tags map[string]string
+		keep bool
+	}{
+		{
+			name: "equal match",
+			f:    &labelFilter{equal: map[string]string{"req": "abc"}},
+			tags: map[string]string{"req": "abc"},
+			keep: true,
+		},
+		{
+			name: "equal mismatch",
+			f:    &labelFilter{equal: map[string]string{"req": "abc"}},
+			tags: map[string]string{"req": "xyz"},
+			keep: false,
+		},
+		{
+			name: "tagfocus present",
+			f:    &labelFilter{focus: regexp.MustCompile("slow")},
+			tags: map[string]string{"phase": "slow"},
+			keep: true,
+		},
+		{
+			name: "tagfocus absent",
+			f:    &labelFilter{focus: regexp.MustCompile("slow")},
+			tags: map[string]string{"phase": "fast"},
+			keep: false,
+		},
+		{
+			name: "tagignore present",
+			f:    &labelFilter{ignore: regexp.MustCompile("test")},
+			tags: map[string]string{"env": "test"},
+			keep: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.f.keep(tc.tags); got != tc.keep {
+				t.Errorf("keep(%v) = %v, want %v", tc.tags, got, tc.keep)
+			}
+		})
+	}
+}
+
+// encodeTestSample builds a minimal Sample message with one str label
+// (key and value looked up in strTable by index) and the given value, in
+// the same hand-rolled encoding filterProfile/decodeSample work with.
+func encodeTestSample(keyIdx, valIdx int, value int64) []byte {
+	var label []byte
+	label = appendTag(label, labelFieldKey, 0)
+	label = appendVarint(label, uint64(keyIdx))
+	label = appendTag(label, labelFieldStr, 0)
+	label = appendVarint(label, uint64(valIdx))
+
+	var sample []byte
+	sample = appendTag(sample, sampleFieldLabel, 2)
+	sample = appendVarint(sample, uint64(len(label)))
+	sample = append(sample, label...)
+	sample = appendTag(sample, sampleFieldValue, 0)
+	sample = appendVarint(sample, uint64(value))
+	return sample
+}
+
+// encodeStringTableEntry builds the raw bytes of one string_table field.
+func encodeStringTableEntry(s string) []byte {
+	var out []byte
+	out = appendTag(out, profileFieldStringTable, 2)
+	out = appendVarint(out, uint64(len(s)))
+	out = append(out, s...)
+	return out
+}
+
+func TestFilterProfile(t *testing.T) {
+	strTable := []string{"", "env", "prod", "test"}
+	prodSample := encodeTestSample(1, 2, 10)
+	testSample := encodeTestSample(1, 3, 20)
+
+	p := &pbProfile{strTable: strTable}
+	for _, s := range strTable {
+		p.other = append(p.other, pbField{
+			num:  profileFieldStringTable,
+			wire: 2,
+			raw:  encodeStringTableEntry(s),
+		})
+	}
+	for _, s := range [][]byte{prodSample, testSample} {
+		decoded, err := decodeSample(s, strTable)
+		if err != nil {
+			t.Fatalf("decodeSample: %v", err)
+		}
+		p.samples = append(p.samples, decoded)
+	}
+	raw, err := p.encode()
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	f := &labelFilter{equal: map[string]string{"env": "prod"}}
+	out, err := filterProfile(raw, f)
+	if err != nil {
+		t.Fatalf("filterProfile: %v", err)
+	}
+	filtered, err := decodeProfile(out)
+	if err != nil {
+		t.Fatalf("decodeProfile of filtered output: %v", err)
+	}
+	if len(filtered.samples) != 1 {
+		t.Fatalf("got %d samples after filtering, want 1", len(filtered.samples))
+	}
+	if got := filtered.samples[0].tags["env"]; got != "prod" {
+		t.Errorf("surviving sample has env=%q, want %q", got, "prod")
+	}
+}
@@ -45,6 +45,25 @@
 // To view all available profiles, open http://localhost:6060/debug/pprof/
 // in your browser.
 //
+// Or to see only what a heap profile gained over a 30-second window,
+// rather than its cumulative snapshot:
+//
+//	go tool pprof http://localhost:6060/debug/pprof/delta/heap?seconds=30
+//
+// A program that tags its work with pprof.Labels can narrow the CPU
+// profile and the named profiles (heap, block, mutex, goroutine, and so
+// on) to just the samples carrying a given label, e.g. only one tenant's
+// goroutines; the execution trace and the delta endpoints are not
+// filtered:
+//
+//	go tool pprof http://localhost:6060/debug/pprof/goroutine?label=tenant=acme
+//
+// Binaries that don't want to expose the full surface above -- for
+// example an agent embedded in a program that runs on end users'
+// devices -- can call Register with an Options.Allow listing only the
+// profiles they intend to serve, instead of importing this package for
+// its init side effect.
+//
 // For a study of the facility in action, visit
 //
 //	https://blog.golang.org/2011/06/profiling-go-programs.html
@@ -54,6 +73,7 @@ package pprof
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
@@ -68,12 +88,23 @@ import (
 	"time"
 )
 
+// disableAutoRegister is the sentinel environment variable that
+// suppresses init's registration of handlers on http.DefaultServeMux. It
+// exists for binaries that import this package only for Register (or
+// Handler), and that would otherwise have no way to keep the full,
+// unauthenticated debug surface from being wired up as a side effect.
+const disableAutoRegister = "GOPPROF_DISABLE_AUTOREGISTER"
+
 func init() {
+	if os.Getenv(disableAutoRegister) != "" {
+		return
+	}
 	http.HandleFunc("/debug/pprof/", Index)
 	http.HandleFunc("/debug/pprof/cmdline", Cmdline)
 	http.HandleFunc("/debug/pprof/profile", Profile)
 	http.HandleFunc("/debug/pprof/symbol", Symbol)
 	http.HandleFunc("/debug/pprof/trace", Trace)
+	http.HandleFunc("/debug/pprof/delta/", Delta)
 }
 
 // Cmdline responds with the running program's
@@ -111,6 +142,11 @@ func serveError(w http.ResponseWriter, status int, txt string) {
 
 // Profile responds with the pprof-formatted cpu profile.
 // The package initialization registers it as /debug/pprof/profile.
+//
+// A request carrying any of the label-filtering query parameters (see
+// labelFilter) is buffered and filtered before being written, rather than
+// streamed straight from StartCPUProfile, so that only samples matching
+// the filter reach the client.
 func Profile(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	sec, _ := strconv.ParseInt(r.FormValue("seconds"), 10, 64)
@@ -123,18 +159,46 @@ func Profile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set Content Type assuming StartCPUProfile will work,
-	// because if it does it starts writing.
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
-	if err := pprof.StartCPUProfile(w); err != nil {
-		// StartCPUProfile failed, so no writes yet.
+	filter, err := parseLabelFilter(r)
+	if err != nil {
+		serveError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if filter.empty() {
+		// Set Content Type assuming StartCPUProfile will work,
+		// because if it does it starts writing.
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+		if err := pprof.StartCPUProfile(w); err != nil {
+			// StartCPUProfile failed, so no writes yet.
+			serveError(w, http.StatusInternalServerError,
+				fmt.Sprintf("Could not enable CPU profiling: %s", err))
+			return
+		}
+		sleep(w, time.Duration(sec)*time.Second)
+		pprof.StopCPUProfile()
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
 		serveError(w, http.StatusInternalServerError,
 			fmt.Sprintf("Could not enable CPU profiling: %s", err))
 		return
 	}
 	sleep(w, time.Duration(sec)*time.Second)
 	pprof.StopCPUProfile()
+
+	out, err := filterProfile(buf.Bytes(), filter)
+	if err != nil {
+		serveError(w, http.StatusInternalServerError, fmt.Sprintf("Could not filter profile: %s", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.Write(out)
 }
 
 // Trace responds with the execution trace in binary form.
@@ -169,50 +233,133 @@ func Trace(w http.ResponseWriter, r *http.Request) {
 // Symbol looks up the program counters listed in the request,
 // responding with a table mapping program counters to function names.
 // The package initialization registers it as /debug/pprof/symbol.
+//
+// The default response is the legacy "pc funcname" text pairs expected by
+// old pprof clients, one pair per line, preceded by the traditional
+// "num_symbols" line.
+//
+// Passing ?format=json instead resolves each PC to {pc, frames} using
+// symbolicate, which walks the inline tree the way runtime.CallersFrames
+// does for a captured stack, so the response carries file/line and every
+// frame inlined at that PC rather than just its innermost function. The
+// response is one JSON object per line -- not a single JSON array.
+//
+// In either format, a GET request whose body holds a large,
+// newline-separated batch of PCs is symbolized and streamed back as it's
+// resolved; the '+'-delimited POST body and query string forms buffer the
+// whole response first.
 func Symbol(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-
-	// We have to read the whole POST body before
-	// writing any output. Buffer the output here.
-	var buf bytes.Buffer
+	jsonFormat := r.FormValue("format") == "json"
 
-	// We don't know how many symbols we have, but we
-	// do have symbol information. Pprof only cares whether
-	// this number is 0 (no symbols available) or > 0.
-	fmt.Fprintf(&buf, "num_symbols: 1\n")
+	// The legacy '+'-delimited form is read from the POST body or, for
+	// small batches, straight from the raw query string; the newer
+	// newline-delimited form is a GET request carrying a body, and is
+	// streamed rather than buffered. ?format=json combines with either
+	// input form, so streaming is decided by method and body presence
+	// alone, not by whether a query string is also present.
+	var rd io.Reader
+	sep := byte('+')
+	streaming := false
+	switch {
+	case r.Method == "GET" && r.ContentLength > 0:
+		rd, sep, streaming = r.Body, '\n', true
+	case r.Method == "POST":
+		rd = r.Body
+	default:
+		rd = strings.NewReader(r.URL.RawQuery)
+	}
+	b := bufio.NewReader(rd)
 
-	var b *bufio.Reader
-	if r.Method == "POST" {
-		b = bufio.NewReader(r.Body)
+	if jsonFormat {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	} else {
-		b = bufio.NewReader(strings.NewReader(r.URL.RawQuery))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	// The '+'-delimited forms have to read the whole request body before
+	// writing any output; buffer it here. The streaming form writes
+	// straight to w.
+	var buf bytes.Buffer
+	out := io.Writer(&buf)
+	if streaming {
+		out = w
+	}
+	if !jsonFormat {
+		// We don't know how many symbols we have, but we
+		// do have symbol information. Pprof only cares whether
+		// this number is 0 (no symbols available) or > 0.
+		fmt.Fprintf(out, "num_symbols: 1\n")
 	}
 
+	enc := json.NewEncoder(out)
 	for {
-		word, err := b.ReadSlice('+')
+		word, err := b.ReadSlice(sep)
 		if err == nil {
-			word = word[0 : len(word)-1] // trim +
+			word = word[0 : len(word)-1] // trim the separator
 		}
-		pc, _ := strconv.ParseUint(string(word), 0, 64)
-		if pc != 0 {
-			f := runtime.FuncForPC(uintptr(pc))
-			if f != nil {
-				fmt.Fprintf(&buf, "%#x %s\n", pc, f.Name())
+		if pc, perr := strconv.ParseUint(strings.TrimSpace(string(word)), 0, 64); perr == nil && pc != 0 {
+			if jsonFormat {
+				enc.Encode(symbolResult{PC: pc, Frames: symbolicate(pc)})
+			} else if f := runtime.FuncForPC(uintptr(pc)); f != nil {
+				fmt.Fprintf(out, "%#x %s\n", pc, f.Name())
 			}
 		}
 
 		// Wait until here to check for err; the last
-		// symbol will have an err because it doesn't end in +.
+		// symbol will have an err because it doesn't end in a separator.
 		if err != nil {
 			if err != io.EOF {
-				fmt.Fprintf(&buf, "reading request: %v\n", err)
+				fmt.Fprintf(out, "reading request: %v\n", err)
 			}
 			break
 		}
 	}
 
-	w.Write(buf.Bytes())
+	if !streaming {
+		w.Write(buf.Bytes())
+	}
+}
+
+// symbolResult is the ?format=json response shape for a single resolved
+// program counter.
+type symbolResult struct {
+	PC     uint64  `json:"pc"`
+	Frames []frame `json:"frames"`
+}
+
+// frame describes one, possibly inlined, stack frame resolved from a
+// program counter.
+type frame struct {
+	Func    string `json:"func"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Inlined bool   `json:"inlined"`
+}
+
+// symbolicate resolves pc to its innermost frame and, walking outward,
+// every frame inlined at pc above it, using the same frame iteration
+// runtime.CallersFrames performs for a captured stack trace -- applied
+// here to a single client-supplied PC rather than one from runtime.Callers.
+func symbolicate(pc uint64) []frame {
+	frames := runtime.CallersFrames([]uintptr{uintptr(pc)})
+	var out []frame
+	for i := 0; ; i++ {
+		f, more := frames.Next()
+		if f.PC == 0 && f.Function == "" {
+			break
+		}
+		out = append(out, frame{
+			Func:    f.Function,
+			File:    f.File,
+			Line:    f.Line,
+			Inlined: i > 0,
+		})
+		if !more {
+			break
+		}
+	}
+	return out
 }
 
 // Handler returns an HTTP handler that serves the named profile.
@@ -224,6 +371,11 @@ type handler string
 
 // /debug/pprof/ 的处理函数，比如 /debug/pprof/heap，
 // 那么name=heap，通过pprof.Lookup(string(name))找到对应的Profile
+// ServeHTTP serves the named profile. If the request carries any of the
+// label-filtering query parameters (see labelFilter), and the profile is
+// requested in its binary, non-debug form, the profile is decoded and
+// samples not matching the filter are dropped before the result is
+// written.
 func (name handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	p := pprof.Lookup(string(name))
@@ -236,13 +388,150 @@ func (name handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		runtime.GC()
 	}
 	debug, _ := strconv.Atoi(r.FormValue("debug"))
-	if debug != 0 {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	} else {
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+
+	filter, err := parseLabelFilter(r)
+	if err != nil {
+		serveError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if debug != 0 || filter.empty() {
+		if debug != 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+		}
+		p.WriteTo(w, debug)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := p.WriteTo(&buf, debug); err != nil {
+		serveError(w, http.StatusInternalServerError, fmt.Sprintf("Could not collect profile: %s", err))
+		return
+	}
+	out, err := filterProfile(buf.Bytes(), filter)
+	if err != nil {
+		serveError(w, http.StatusInternalServerError, fmt.Sprintf("Could not filter profile: %s", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	w.Write(out)
+}
+
+// Options configures Register's alternate registration of the profile
+// handlers, for callers that don't want every profile wired onto
+// http.DefaultServeMux the way init does.
+type Options struct {
+	// Allow restricts which profiles Register serves. A nil or empty
+	// Allow serves every profile, matching init's behavior. Index lists,
+	// and the handlers serve, only names present in Allow; everything
+	// else is rejected as if it didn't exist.
+	Allow []string
+
+	// Authorize, if non-nil, is called before a handler does any work.
+	// A non-nil error is treated the same as a disallowed profile name:
+	// the request is rejected with 404, so a caller that isn't authorized
+	// can't distinguish "rejected" from "not registered".
+	Authorize func(*http.Request) error
+
+	// PathPrefix replaces the leading "/debug/pprof" in every path
+	// Register wires up, so operators can mount the handlers under an
+	// arbitrary path. The default is "/debug/pprof".
+	PathPrefix string
+}
+
+func (o *Options) allowed(name string) bool {
+	if len(o.Allow) == 0 {
+		return true
+	}
+	for _, a := range o.Allow {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Options) authorized(r *http.Request) bool {
+	return o.Authorize == nil || o.Authorize(r) == nil
+}
+
+// Register wires the profiles named by opts.Allow (or every profile, if
+// opts is nil or opts.Allow is empty) onto mux, rooted at opts.PathPrefix
+// (or "/debug/pprof" if empty), including delta/<profile> for the
+// delta-capable profiles (see DeltaHandler). Unlike init's unconditional
+// registration on http.DefaultServeMux, Register lets a caller ship
+// pprof's HTTP handlers while keeping cmdline, profile, trace, and
+// symbol -- or any other profile -- unreachable, and while gating every
+// request on opts.Authorize.
+//
+// Disallowed names and failed authorization both respond with 404, not
+// 403, so a prober can't tell a missing profile from one it isn't
+// allowed to see. Index only lists the names the request is allowed to
+// see.
+func Register(mux *http.ServeMux, opts *Options) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	prefix := strings.TrimSuffix(opts.PathPrefix, "/")
+	if prefix == "" {
+		prefix = "/debug/pprof"
+	}
+
+	reject := func(w http.ResponseWriter) {
+		serveError(w, http.StatusNotFound, "Unknown profile")
+	}
+	guard := func(name string, h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if (name != "" && !opts.allowed(name)) || !opts.authorized(r) {
+				reject(w)
+				return
+			}
+			h(w, r)
+		}
+	}
+
+	mux.HandleFunc(prefix+"/", guard("", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, prefix+"/")
+		if name == "" {
+			writeIndex(w, opts)
+			return
+		}
+		if !opts.allowed(name) {
+			reject(w)
+			return
+		}
+		handler(name).ServeHTTP(w, r)
+	}))
+	mux.HandleFunc(prefix+"/cmdline", guard("cmdline", Cmdline))
+	mux.HandleFunc(prefix+"/profile", guard("profile", Profile))
+	mux.HandleFunc(prefix+"/symbol", guard("symbol", Symbol))
+	mux.HandleFunc(prefix+"/trace", guard("trace", Trace))
+	mux.HandleFunc(prefix+"/delta/", guard("", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, prefix+"/delta/")
+		if name == "" || !opts.allowed(name) {
+			reject(w)
+			return
+		}
+		DeltaHandler(name, 30*time.Second).ServeHTTP(w, r)
+	}))
+}
+
+// writeIndex renders the index page listing only the profiles opts
+// allows, the restricted-registration analogue of Index's listing.
+func writeIndex(w http.ResponseWriter, opts *Options) {
+	var profiles []*pprof.Profile
+	for _, p := range pprof.Profiles() {
+		if opts.allowed(p.Name()) {
+			profiles = append(profiles, p)
+		}
+	}
+	if err := indexTmpl.Execute(w, profiles); err != nil {
+		log.Print(err)
 	}
-	p.WriteTo(w, debug)
 }
 
 // Index responds with the pprof-formatted profile named by the request.
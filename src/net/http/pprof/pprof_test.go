@@ -0,0 +1,118 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pprof
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	mux := http.NewServeMux()
+	Register(mux, &Options{
+		Allow: []string{"heap"},
+		Authorize: func(r *http.Request) error {
+			if r.Header.Get("X-Auth") != "ok" {
+				return errUnauthorized
+			}
+			return nil
+		},
+	})
+
+	testCases := []struct {
+		name       string
+		path       string
+		auth       bool
+		statusCode int
+	}{
+		{"allowed profile, authorized", "/debug/pprof/heap", true, http.StatusOK},
+		{"allowed profile, unauthorized", "/debug/pprof/heap", false, http.StatusNotFound},
+		{"disallowed profile, authorized", "/debug/pprof/goroutine", true, http.StatusNotFound},
+		{"disallowed endpoint, authorized", "/debug/pprof/cmdline", true, http.StatusNotFound},
+		{"index, authorized", "/debug/pprof/", true, http.StatusOK},
+		{"index, unauthorized", "/debug/pprof/", false, http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com"+tc.path, nil)
+			if tc.auth {
+				req.Header.Set("X-Auth", "ok")
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if got := w.Result().StatusCode; got != tc.statusCode {
+				t.Errorf("status code: got %d; want %d", got, tc.statusCode)
+			}
+		})
+	}
+}
+
+type authError string
+
+func (e authError) Error() string { return string(e) }
+
+const errUnauthorized = authError("unauthorized")
+
+func TestSymbol(t *testing.T) {
+	pc := reflect.ValueOf(TestSymbol).Pointer()
+	pcStr := strconv.FormatUint(uint64(pc), 16)
+
+	testCases := []struct {
+		name        string
+		method      string
+		target      string
+		body        string
+		contentType string
+	}{
+		{"GET legacy query", "GET", "/debug/pprof/symbol?0x" + pcStr, "", "text/plain; charset=utf-8"},
+		{"POST legacy body", "POST", "/debug/pprof/symbol", "0x" + pcStr, "text/plain; charset=utf-8"},
+		{"GET streaming body", "GET", "/debug/pprof/symbol", "0x" + pcStr + "\n", "text/plain; charset=utf-8"},
+		{"GET streaming body json", "GET", "/debug/pprof/symbol?format=json", "0x" + pcStr + "\n", "application/json; charset=utf-8"},
+		{"POST body json", "POST", "/debug/pprof/symbol?format=json", "0x" + pcStr, "application/json; charset=utf-8"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body *strings.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			} else {
+				body = strings.NewReader("")
+			}
+			req := httptest.NewRequest(tc.method, "http://example.com"+tc.target, body)
+			w := httptest.NewRecorder()
+			Symbol(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Type"); got != tc.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tc.contentType)
+			}
+			if got := resp.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+			}
+
+			if strings.Contains(tc.contentType, "json") {
+				var res symbolResult
+				if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+					t.Fatalf("decoding JSON response: %v\nbody: %s", err, w.Body.String())
+				}
+				if res.PC != uint64(pc) || len(res.Frames) == 0 {
+					t.Errorf("got %+v, want pc=%#x with at least one frame", res, pc)
+				}
+			} else {
+				if !strings.Contains(w.Body.String(), "TestSymbol") {
+					t.Errorf("body doesn't mention the resolved function:\n%s", w.Body.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pprof
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// This file decodes and re-encodes just enough of the gzip+protobuf wire
+// format produced by runtime/pprof's WriteTo(w, 0) -- described by
+// https://github.com/google/pprof/blob/main/proto/profile.proto -- for
+// labelFilter and diffProfiles to drop or combine samples. It exists so
+// neither feature needs an external dependency: the standard library
+// can't import an unvendored module, so every field decodeProfile doesn't
+// model (mappings, locations, functions, sample types, and so on) is
+// carried through as opaque bytes; diffProfiles reads locations and
+// functions back out of those bytes where it needs them.
+//
+// Profile field numbers used below (see profile.proto):
+//
+//	sample       = 2 (repeated Sample)
+//	string_table = 6 (repeated string)
+//
+// Sample field numbers:
+//
+//	location_id = 1 (repeated uint64; packed only when there are >2)
+//	value       = 2 (repeated int64; packed only when there are >2)
+//	label       = 3 (repeated Label)
+//
+// Label field numbers:
+//
+//	key = 1, str = 2, num = 3 (all varint)
+const (
+	profileFieldSample      = 2
+	profileFieldLocation    = 4
+	profileFieldFunction    = 5
+	profileFieldStringTable = 6
+
+	sampleFieldLocationID = 1
+	sampleFieldValue      = 2
+	sampleFieldLabel      = 3
+
+	labelFieldKey = 1
+	labelFieldStr = 2
+	labelFieldNum = 3
+
+	locationFieldID   = 1
+	locationFieldLine = 4
+
+	lineFieldFunctionID = 1
+	lineFieldLine       = 2
+
+	functionFieldID       = 1
+	functionFieldName     = 2
+	functionFieldFilename = 4
+)
+
+// pbField is one field decoded from a protobuf message: its field number
+// and wire type, the field's value (for wire type 0, the varint; for wire
+// type 2, the length-delimited content), and raw, its exact original
+// encoding (tag and payload), kept so fields this package doesn't
+// interpret can be copied through unchanged.
+type pbField struct {
+	num     int
+	wire    int
+	value   uint64
+	content []byte
+	raw     []byte
+}
+
+// readVarint decodes a base-128 varint from the front of b, returning its
+// value and the number of bytes consumed, or n == 0 if b does not hold a
+// complete varint.
+func readVarint(b []byte) (v uint64, n int) {
+	for i := 0; i < len(b) && i < 10; i++ {
+		c := b[i]
+		v |= uint64(c&0x7f) << uint(7*i)
+		if c&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+func appendVarint(dst []byte, v uint64) []byte {
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func appendTag(dst []byte, num, wire int) []byte {
+	return appendVarint(dst, uint64(num)<<3|uint64(wire))
+}
+
+// parseFields decodes every top-level field in b, in encounter order.
+// b may be a whole message or the content of a length-delimited
+// submessage; the grammar is the same either way.
+func parseFields(b []byte) ([]pbField, error) {
+	var fields []pbField
+	for len(b) > 0 {
+		tag, tn := readVarint(b)
+		if tn == 0 {
+			return nil, errors.New("pprof: truncated field tag")
+		}
+		num, wire := int(tag>>3), int(tag&7)
+		var f pbField
+		switch wire {
+		case 0:
+			v, n := readVarint(b[tn:])
+			if n == 0 {
+				return nil, errors.New("pprof: truncated varint field")
+			}
+			f = pbField{num: num, wire: wire, value: v, raw: b[:tn+n]}
+		case 1:
+			if len(b)-tn < 8 {
+				return nil, errors.New("pprof: truncated 64-bit field")
+			}
+			f = pbField{num: num, wire: wire, raw: b[:tn+8]}
+		case 2:
+			l, ln := readVarint(b[tn:])
+			if ln == 0 || uint64(len(b)-tn-ln) < l {
+				return nil, errors.New("pprof: truncated length-delimited field")
+			}
+			f = pbField{num: num, wire: wire, content: b[tn+ln : tn+ln+int(l)], raw: b[:tn+ln+int(l)]}
+		case 5:
+			if len(b)-tn < 4 {
+				return nil, errors.New("pprof: truncated 32-bit field")
+			}
+			f = pbField{num: num, wire: wire, raw: b[:tn+4]}
+		default:
+			return nil, fmt.Errorf("pprof: unsupported wire type %d", wire)
+		}
+		fields = append(fields, f)
+		b = b[len(f.raw):]
+	}
+	return fields, nil
+}
+
+// decodePackedVarints decodes a packed repeated varint field, as used by
+// Sample's location_id and value fields.
+func decodePackedVarints(b []byte) ([]int64, error) {
+	var out []int64
+	for len(b) > 0 {
+		v, n := readVarint(b)
+		if n == 0 {
+			return nil, errors.New("pprof: truncated packed varint")
+		}
+		out = append(out, int64(v))
+		b = b[n:]
+	}
+	return out, nil
+}
+
+func encodePackedVarints(vs []int64) []byte {
+	var out []byte
+	for _, v := range vs {
+		out = appendVarint(out, uint64(v))
+	}
+	return out
+}
+
+// pbSample is a decoded Sample message: its values (field 2), and every
+// other field (location_id, label, and anything this package doesn't
+// know about) kept verbatim in other so it round-trips unchanged. tags is
+// derived from the label fields, for labelFilter and diffProfiles to
+// consult without re-parsing.
+type pbSample struct {
+	other  []pbField
+	values []int64
+	tags   map[string]string
+}
+
+func decodeSample(content []byte, strTable []string) (*pbSample, error) {
+	fields, err := parseFields(content)
+	if err != nil {
+		return nil, err
+	}
+	s := &pbSample{tags: map[string]string{}}
+	for _, f := range fields {
+		if f.num == sampleFieldValue {
+			// protobuf.uint64s/int64s (runtime/pprof/protobuf.go) only
+			// packs a repeated field when it has more than two elements;
+			// with one or two it falls back to repeating the tag, so
+			// value (and, below in other, location_id) must be read
+			// either way.
+			switch f.wire {
+			case 2:
+				vals, err := decodePackedVarints(f.content)
+				if err != nil {
+					return nil, err
+				}
+				s.values = append(s.values, vals...)
+			case 0:
+				s.values = append(s.values, int64(f.value))
+			}
+			continue
+		}
+		if f.num == sampleFieldLabel && f.wire == 2 {
+			k, v, err := decodeLabel(f.content, strTable)
+			if err != nil {
+				return nil, err
+			}
+			if k != "" {
+				s.tags[k] = v
+			}
+		}
+		s.other = append(s.other, f)
+	}
+	return s, nil
+}
+
+func decodeLabel(content []byte, strTable []string) (key, val string, err error) {
+	fields, err := parseFields(content)
+	if err != nil {
+		return "", "", err
+	}
+	var keyIdx, strIdx int
+	var num int64
+	haveStr, haveNum := false, false
+	for _, f := range fields {
+		switch f.num {
+		case labelFieldKey:
+			keyIdx = int(f.value)
+		case labelFieldStr:
+			strIdx, haveStr = int(f.value), true
+		case labelFieldNum:
+			num, haveNum = int64(f.value), true
+		}
+	}
+	key = strAt(strTable, keyIdx)
+	switch {
+	case haveStr:
+		val = strAt(strTable, strIdx)
+	case haveNum:
+		val = fmt.Sprintf("%d", num)
+	}
+	return key, val, nil
+}
+
+func strAt(t []string, i int) string {
+	if i < 0 || i >= len(t) {
+		return ""
+	}
+	return t[i]
+}
+
+// locationIDs returns the location_id list s's stack was collected
+// against, in the numbering of whichever profile s was decoded from.
+// location_id is a repeated field that, like value, is only
+// packed when it has more than two elements (see decodeSample), so a
+// two-frame stack is encoded as two separate wire-type-0 fields rather
+// than one wire-type-2 field.
+func (s *pbSample) locationIDs() ([]uint64, error) {
+	var ids []uint64
+	for _, f := range s.other {
+		if f.num != sampleFieldLocationID {
+			continue
+		}
+		switch f.wire {
+		case 2:
+			vals, err := decodePackedVarints(f.content)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range vals {
+				ids = append(ids, uint64(v))
+			}
+		case 0:
+			ids = append(ids, f.value)
+		}
+	}
+	return ids, nil
+}
+
+func (s *pbSample) encode() []byte {
+	var buf []byte
+	for _, f := range s.other {
+		buf = append(buf, f.raw...)
+	}
+	if len(s.values) > 0 {
+		packed := encodePackedVarints(s.values)
+		buf = appendTag(buf, sampleFieldValue, 2)
+		buf = appendVarint(buf, uint64(len(packed)))
+		buf = append(buf, packed...)
+	}
+	return buf
+}
+
+// pbProfile is a decoded Profile message: its samples, and every other
+// field (string table, mappings, locations, functions, sample types,
+// and so on) kept verbatim in other.
+type pbProfile struct {
+	strTable []string
+	other    []pbField
+	samples  []*pbSample
+}
+
+// decodeProfile gunzips and decodes a whole profile as produced by
+// runtime/pprof's (*Profile).WriteTo(w, 0).
+func decodeProfile(raw []byte) (*pbProfile, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := parseFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pbProfile{}
+	for _, f := range fields {
+		if f.num == profileFieldStringTable && f.wire == 2 {
+			p.strTable = append(p.strTable, string(f.content))
+		}
+	}
+	for _, f := range fields {
+		if f.num == profileFieldSample && f.wire == 2 {
+			s, err := decodeSample(f.content, p.strTable)
+			if err != nil {
+				return nil, err
+			}
+			p.samples = append(p.samples, s)
+			continue
+		}
+		p.other = append(p.other, f)
+	}
+	return p, nil
+}
+
+// encode re-assembles a profile from its (possibly filtered or combined)
+// samples and its untouched other fields, and gzips the result.
+func (p *pbProfile) encode() ([]byte, error) {
+	var buf []byte
+	for _, f := range p.other {
+		buf = append(buf, f.raw...)
+	}
+	for _, s := range p.samples {
+		content := s.encode()
+		buf = appendTag(buf, profileFieldSample, 2)
+		buf = appendVarint(buf, uint64(len(content)))
+		buf = append(buf, content...)
+	}
+
+	var out bytes.Buffer
+	gz := gzip.NewWriter(&out)
+	if _, err := gz.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}